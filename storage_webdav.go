@@ -29,6 +29,7 @@ import (
 	"os"
 	"path"
 	"strconv"
+	"time"
 
 	"github.com/emersion/go-webdav"
 	"gopkg.in/yaml.v3"
@@ -39,6 +40,22 @@ import (
 type WebDavStorageOption struct {
 	PreGenMeasures bool `yaml:"pre-gen-measures"`
 
+	// Lock selects how concurrent writers to a shared bucket are coordinated:
+	// "server" (default) issues real LOCK/UNLOCK requests, "memory" arbitrates
+	// locally for servers that don't support DAV class 2, and "none" disables
+	// locking entirely.
+	Lock string `yaml:"lock,omitempty"`
+	// LockTimeout is the lock duration requested from the server, in seconds.
+	// Zero uses defaultLockTimeout.
+	LockTimeout int `yaml:"lock-timeout,omitempty"`
+
+	// ChunkUpload selects the chunked-upload driver used by Create: "none"
+	// (default), "nextcloud-v1", or "nextcloud-v2".
+	ChunkUpload string `yaml:"chunk-upload,omitempty"`
+	// ChunkSize is the size of each uploaded chunk, in bytes. Zero uses
+	// defaultChunkSize.
+	ChunkSize int64 `yaml:"chunk-size,omitempty"`
+
 	Alias     string `yaml:"alias,omitempty"`
 	aliasUser *WebDavUser
 
@@ -94,7 +111,8 @@ func (o *WebDavStorageOption) GetPassword() string {
 type WebDavStorage struct {
 	opt WebDavStorageOption
 
-	cli *webdav.Client
+	cli    *webdav.Client
+	locker *webdavLocker
 }
 
 var _ Storage = (*WebDavStorage)(nil)
@@ -143,15 +161,20 @@ func (s *WebDavStorage) Init(ctx context.Context) (err error) {
 		s.opt.fullEndPoint = s.opt.EndPoint
 	}
 
-	if s.cli, err = webdav.NewClient(
-		&HTTPClientWithUserAgent{
-			HTTPClient: webdav.HTTPClientWithBasicAuth(http.DefaultClient, s.opt.GetUsername(), s.opt.GetPassword()),
-			UserAgent:  ClusterUserAgentFull,
-		},
-		s.opt.GetEndPoint()); err != nil {
+	httpCli := &HTTPClientWithUserAgent{
+		HTTPClient: webdav.HTTPClientWithBasicAuth(http.DefaultClient, s.opt.GetUsername(), s.opt.GetPassword()),
+		UserAgent:  ClusterUserAgentFull,
+	}
+	if s.cli, err = webdav.NewClient(httpCli, s.opt.GetEndPoint()); err != nil {
 		return
 	}
 
+	lockMode := webdavLockMode(s.opt.Lock)
+	if lockMode == "" {
+		lockMode = WebdavLockServer
+	}
+	s.locker = newWebdavLocker(lockMode, time.Duration(s.opt.LockTimeout)*time.Second, httpCli, s.opt.GetEndPoint(), s.String())
+
 	if err = s.cli.Mkdir(ctx, "measure"); err != nil {
 		logErrorf("Could not create measure folder for %s: %v", s.String(), err)
 	}
@@ -174,21 +197,25 @@ func (s *WebDavStorage) hashToPath(hash string) string {
 func (s *WebDavStorage) Size(hash string) (int64, error) {
 	stat, err := s.cli.Stat(context.Background(), s.hashToPath(hash))
 	if err != nil {
-		return 0, err
+		return 0, classifyDAVErr(err)
 	}
 	return stat.Size, nil
 }
 
 func (s *WebDavStorage) Open(hash string) (io.ReadCloser, error) {
-	return s.cli.Open(context.Background(), s.hashToPath(hash))
+	r, err := s.cli.Open(context.Background(), s.hashToPath(hash))
+	if err != nil {
+		return nil, classifyDAVErr(err)
+	}
+	return r, nil
 }
 
 func (s *WebDavStorage) Create(hash string) (io.WriteCloser, error) {
-	return s.cli.Create(context.Background(), s.hashToPath(hash))
+	return s.create(hash, "")
 }
 
 func (s *WebDavStorage) Remove(hash string) error {
-	return s.cli.RemoveAll(context.Background(), s.hashToPath(hash))
+	return classifyDAVErr(s.cli.RemoveAll(context.Background(), s.hashToPath(hash)))
 }
 
 func (s *WebDavStorage) WalkDir(walker func(hash string) error) error {
@@ -277,7 +304,7 @@ func (s *WebDavStorage) ServeDownload(rw http.ResponseWriter, req *http.Request,
 		n, _ := io.Copy(rw, resp.Body)
 		return n, nil
 	default:
-		return 0, webdav.NewHTTPError(resp.StatusCode, nil)
+		return 0, parseDAVError(resp.StatusCode, resp.Body)
 	}
 }
 
@@ -349,11 +376,12 @@ func (s *WebDavStorage) createMeasureFile(ctx context.Context, size int) (err er
 		logErrorf("Cannot get stat of %s: %v", t, err)
 	}
 	logInfof("Creating measure file at %q", t)
-	w, err := s.cli.Create(ctx, t)
+	lock, err := s.locker.lock(ctx, t)
 	if err != nil {
-		logErrorf("Cannot create measure file %q: %v", t, err)
+		logErrorf("Cannot lock measure file %q: %v", t, err)
 		return
 	}
+	w := s.createLocked(ctx, t, lock)
 	defer func() {
 		if e := w.Close(); e != nil && err == nil {
 			logErrorf("Could not create measure file %q: %v", t, err)
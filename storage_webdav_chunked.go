@@ -0,0 +1,332 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+)
+
+// chunkUploadDriver selects the chunked-upload protocol used by
+// WebDavStorage.Create for large files over unreliable links.
+type chunkUploadDriver string
+
+const (
+	// ChunkUploadNone streams a single PUT, as before.
+	ChunkUploadNone chunkUploadDriver = "none"
+	// ChunkUploadNextcloudV1 uploads numbered chunks under
+	// uploads/<user>/<transfer-id>/<index> then MOVEs the assembly to the
+	// final path with an OC-Total-Length header.
+	ChunkUploadNextcloudV1 chunkUploadDriver = "nextcloud-v1"
+	// ChunkUploadNextcloudV2 MKCOLs the transfer directory first, PUTs
+	// fixed-size chunks with OC-Chunk-Offset, then MOVEs ".file" to the
+	// final path.
+	ChunkUploadNextcloudV2 chunkUploadDriver = "nextcloud-v2"
+)
+
+const (
+	defaultChunkSize  = 10 * 1024 * 1024 // 10 MiB, matches Nextcloud's default
+	chunkMaxRetries   = 5
+	chunkRetryBackoff = 500 * time.Millisecond
+)
+
+// TransferIDer is implemented by the writer returned from Create when
+// chunked uploads are enabled. The sync layer can read TransferID() after
+// every successful chunk and persist it so a later CreateResumable call can
+// pick the upload back up instead of restarting from zero.
+type TransferIDer interface {
+	TransferID() string
+}
+
+// ResumableCreator is an optional Storage capability for backends that can
+// resume an interrupted chunked upload given a transfer ID obtained from a
+// previous TransferIDer.
+type ResumableCreator interface {
+	CreateResumable(hsh, transferID string) (io.WriteCloser, error)
+}
+
+var _ ResumableCreator = (*WebDavStorage)(nil)
+
+// CreateResumable behaves like Create, but resumes transferID instead of
+// starting a fresh upload when the configured chunk-upload driver supports
+// it. If chunked uploads are disabled, it behaves exactly like Create and
+// ignores transferID.
+func (s *WebDavStorage) CreateResumable(hsh, transferID string) (io.WriteCloser, error) {
+	return s.create(hsh, transferID)
+}
+
+func (s *WebDavStorage) create(hsh, resumeTransferID string) (io.WriteCloser, error) {
+	driver := chunkUploadDriver(s.opt.ChunkUpload)
+	if driver == "" || driver == ChunkUploadNone {
+		return s.createSingle(hsh)
+	}
+
+	ctx := context.Background()
+	dest := s.hashToPath(hsh)
+	lock, err := s.locker.lock(ctx, dest)
+	if err != nil {
+		return nil, err
+	}
+
+	transferID := resumeTransferID
+	if transferID == "" {
+		transferID = newTransferID()
+	}
+	chunkSize := s.opt.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	}
+
+	cw := &chunkedUploadWriter{
+		s:          s,
+		driver:     driver,
+		chunkSize:  chunkSize,
+		dest:       dest,
+		transferID: transferID,
+		lock:       lock,
+		sha1:       sha1.New(),
+		md5:        md5.New(),
+	}
+	if resumeTransferID != "" {
+		if err := cw.resumeFrom(ctx, resumeTransferID); err != nil {
+			lock.unlock()
+			return nil, err
+		}
+	}
+	return cw, nil
+}
+
+func (s *WebDavStorage) createSingle(hsh string) (io.WriteCloser, error) {
+	ctx := context.Background()
+	p := s.hashToPath(hsh)
+	lock, err := s.locker.lock(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	return s.createLocked(ctx, p, lock), nil
+}
+
+func newTransferID() string {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		// crypto/rand failing is effectively unrecoverable; fall back to a
+		// time-derived id so the upload can still proceed.
+		return fmt.Sprintf("t%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(buf[:])
+}
+
+// chunkedUploadWriter buffers writes into fixed-size chunks, uploads each one
+// with retries, and finalizes the assembly on Close.
+type chunkedUploadWriter struct {
+	s          *WebDavStorage
+	driver     chunkUploadDriver
+	chunkSize  int64
+	dest       string
+	transferID string
+	lock       *webdavHeldLock
+
+	buf      []byte
+	index    int
+	total    int64
+	skip     int64 // bytes of a resumed upload that Write still has to discard
+	sha1     hash.Hash
+	md5      hash.Hash
+	mkcolled bool
+	closed   bool
+}
+
+func (w *chunkedUploadWriter) TransferID() string {
+	return w.transferID
+}
+
+func (w *chunkedUploadWriter) transferDir() string {
+	return path.Join("uploads", w.s.opt.GetUsername(), w.transferID)
+}
+
+// resumeFrom figures out how many chunks of a previous attempt already made
+// it to the server, so Write can skip re-uploading them.
+func (w *chunkedUploadWriter) resumeFrom(ctx context.Context, transferID string) error {
+	infos, err := w.s.cli.ReadDir(ctx, w.transferDir(), false)
+	if err != nil {
+		// Nothing uploaded yet under this transfer id; start from scratch.
+		return nil
+	}
+	w.mkcolled = true
+	// ReadDir's order is server-defined (PROPFIND makes no ordering promise,
+	// and even a plain alphabetical sort would put "10" before "2"), so the
+	// max index and the total size must each be computed over every chunk
+	// unconditionally rather than accumulated while iterating in index order.
+	maxIdx := -1
+	var resumedBytes int64
+	for _, info := range infos {
+		if info.IsDir {
+			continue
+		}
+		idx, err := strconv.Atoi(path.Base(info.Path))
+		if err != nil {
+			continue
+		}
+		resumedBytes += info.Size
+		if idx > maxIdx {
+			maxIdx = idx
+		}
+	}
+	w.index = maxIdx + 1
+	w.total = resumedBytes
+	w.skip = resumedBytes
+	logInfof("Resuming chunked upload %s at chunk %d (%d bytes already uploaded)", transferID, w.index, resumedBytes)
+	return nil
+}
+
+func (w *chunkedUploadWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, fmt.Errorf("webdav: write to closed chunked upload")
+	}
+	n := len(p)
+	w.sha1.Write(p)
+	w.md5.Write(p)
+	if w.skip > 0 {
+		if int64(len(p)) <= w.skip {
+			w.skip -= int64(len(p))
+			return n, nil
+		}
+		p = p[w.skip:]
+		w.skip = 0
+	}
+	w.buf = append(w.buf, p...)
+	for int64(len(w.buf)) >= w.chunkSize {
+		if err := w.flushChunk(w.buf[:w.chunkSize]); err != nil {
+			return 0, err
+		}
+		w.buf = w.buf[w.chunkSize:]
+	}
+	return n, nil
+}
+
+func (w *chunkedUploadWriter) flushChunk(data []byte) error {
+	ctx := context.Background()
+	if w.driver == ChunkUploadNextcloudV2 && !w.mkcolled {
+		if err := w.s.cli.Mkdir(ctx, w.transferDir()); err != nil {
+			return fmt.Errorf("webdav: could not create chunked upload directory: %w", classifyDAVErr(err))
+		}
+		w.mkcolled = true
+	}
+
+	target := joinDavPath(w.s.opt.GetEndPoint(), path.Join(w.transferDir(), strconv.Itoa(w.index)))
+	offset := w.total
+
+	var lastErr error
+	for attempt := 0; attempt < chunkMaxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(chunkRetryBackoff * time.Duration(math.Pow(2, float64(attempt-1))))
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, target, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		req.ContentLength = int64(len(data))
+		req.SetBasicAuth(w.s.opt.GetUsername(), w.s.opt.GetPassword())
+		if w.driver == ChunkUploadNextcloudV2 {
+			req.Header.Set("OC-Chunk-Offset", strconv.FormatInt(offset, 10))
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		func() {
+			defer resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				lastErr = parseDAVError(resp.StatusCode, resp.Body)
+			} else {
+				lastErr = nil
+			}
+		}()
+		if lastErr == nil {
+			w.index++
+			w.total += int64(len(data))
+			return nil
+		}
+	}
+	return fmt.Errorf("webdav: chunk %d upload failed after %d attempts: %w", w.index, chunkMaxRetries, lastErr)
+}
+
+func (w *chunkedUploadWriter) Close() (err error) {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	defer w.lock.unlock()
+
+	if len(w.buf) > 0 {
+		if err = w.flushChunk(w.buf); err != nil {
+			return err
+		}
+		w.buf = nil
+	}
+
+	ctx := context.Background()
+	var assembly string
+	switch w.driver {
+	case ChunkUploadNextcloudV2:
+		assembly = path.Join(w.transferDir(), ".file")
+	default: // ChunkUploadNextcloudV1
+		assembly = w.transferDir()
+	}
+	target := joinDavPath(w.s.opt.GetEndPoint(), assembly)
+	destination := joinDavPath(w.s.opt.GetEndPoint(), w.dest)
+
+	req, err := http.NewRequestWithContext(ctx, "MOVE", target, nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(w.s.opt.GetUsername(), w.s.opt.GetPassword())
+	req.Header.Set("Destination", destination)
+	req.Header.Set("Overwrite", "T")
+	if ifh := w.lock.ifHeader(); ifh != "" {
+		req.Header.Set("If", ifh)
+	}
+	req.Header.Set("OC-Checksum", fmt.Sprintf("SHA1:%x MD5:%x", w.sha1.Sum(nil), w.md5.Sum(nil)))
+	if w.driver == ChunkUploadNextcloudV1 {
+		req.Header.Set("OC-Total-Length", strconv.FormatInt(w.total, 10))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return parseDAVError(resp.StatusCode, resp.Body)
+	}
+	return nil
+}
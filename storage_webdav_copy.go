@@ -0,0 +1,182 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Mover is an optional Storage capability for backends that can relocate an
+// object without streaming its bytes back through this process, for use by
+// callers doing bulk renames (e.g. hash-layout migrations or moving stale
+// files to a trash prefix before GC). WebDavStorage satisfies it via RFC
+// 4918 MOVE; a local FS backend could satisfy it via os.Rename, but no such
+// backend or caller exists in this tree yet — only WebDavStorage implements
+// Mover/Copier today.
+type Mover interface {
+	Move(srcHash, dstPath string) error
+}
+
+// Copier is an optional Storage capability for backends that can duplicate
+// an object server-side without streaming its bytes through this process.
+// WebDavStorage satisfies it via RFC 4918 COPY; see the Mover doc comment
+// for the current state of other backends/callers.
+type Copier interface {
+	Copy(srcHash, dstPath string, overwrite bool) error
+}
+
+var (
+	_ Mover  = (*WebDavStorage)(nil)
+	_ Copier = (*WebDavStorage)(nil)
+)
+
+// Move relocates srcHash's object to dstPath (relative to the storage root,
+// e.g. "trash/<hash>") using a server-side MOVE, falling back to a
+// stream copy-then-remove if the server doesn't support it.
+func (s *WebDavStorage) Move(srcHash, dstPath string) error {
+	return s.copyOrMove(context.Background(), "MOVE", s.hashToPath(srcHash), dstPath, true)
+}
+
+// Copy duplicates srcHash's object to dstPath using a server-side COPY,
+// falling back to a stream copy if the server doesn't support it.
+func (s *WebDavStorage) Copy(srcHash, dstPath string, overwrite bool) error {
+	return s.copyOrMove(context.Background(), "COPY", s.hashToPath(srcHash), dstPath, overwrite)
+}
+
+// davMultiStatusError is returned when a COPY/MOVE against a collection
+// (Depth: infinity) partially fails; Failures maps the member href to the
+// status it failed with.
+type davMultiStatusError struct {
+	Failures map[string]int
+}
+
+func (e *davMultiStatusError) Error() string {
+	return fmt.Sprintf("webdav: %d member(s) failed in multi-status response", len(e.Failures))
+}
+
+type davMultiStatus struct {
+	XMLName   xml.Name `xml:"multistatus"`
+	Responses []struct {
+		Href     string `xml:"href"`
+		Status   string `xml:"status"`
+		PropStat []struct {
+			Status string `xml:"status"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+// copyOrMove issues a COPY or MOVE request for src, targeting dst on the same
+// endpoint, and falls back to a stream copy (reading src fully and replaying
+// it through Create, removing src afterwards for a MOVE) if the server
+// replies 501 Not Implemented.
+func (s *WebDavStorage) copyOrMove(ctx context.Context, method, src, dst string, overwrite bool) error {
+	target := joinDavPath(s.opt.GetEndPoint(), src)
+	destination := joinDavPath(s.opt.GetEndPoint(), dst)
+	req, err := http.NewRequestWithContext(ctx, method, target, nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(s.opt.GetUsername(), s.opt.GetPassword())
+	req.Header.Set("Destination", destination)
+	req.Header.Set("Depth", "infinity")
+	if overwrite {
+		req.Header.Set("Overwrite", "T")
+	} else {
+		req.Header.Set("Overwrite", "F")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusCreated, http.StatusNoContent:
+		return nil
+	case http.StatusMultiStatus:
+		return parseDAVMultiStatus(resp.Body)
+	case http.StatusNotImplemented:
+		logErrorf("WebDAV storage %s does not support %s, falling back to stream copy", s.String(), method)
+		return s.streamCopyOrMove(ctx, src, dst, method == "MOVE", overwrite)
+	default:
+		return parseDAVError(resp.StatusCode, resp.Body)
+	}
+}
+
+func parseDAVMultiStatus(body io.Reader) error {
+	var ms davMultiStatus
+	if err := xml.NewDecoder(body).Decode(&ms); err != nil {
+		return err
+	}
+	failures := make(map[string]int)
+	for _, r := range ms.Responses {
+		status := r.Status
+		for _, ps := range r.PropStat {
+			if ps.Status != "" {
+				status = ps.Status
+			}
+		}
+		var code int
+		fmt.Sscanf(status, "HTTP/1.1 %d", &code)
+		if code != 0 && code/100 != 2 {
+			failures[r.Href] = code
+		}
+	}
+	if len(failures) == 0 {
+		return nil
+	}
+	return &davMultiStatusError{Failures: failures}
+}
+
+// streamCopyOrMove is the fallback used when the server doesn't support
+// server-side COPY/MOVE: read the source fully and write it back out under
+// dst, removing the source afterwards if this is a move.
+func (s *WebDavStorage) streamCopyOrMove(ctx context.Context, src, dst string, isMove, overwrite bool) error {
+	if !overwrite {
+		if _, err := s.cli.Stat(ctx, dst); err == nil {
+			return &davError{Status: http.StatusPreconditionFailed, Sentinel: ErrDAVPreconditionFailed}
+		}
+	}
+	r, err := s.cli.Open(ctx, src)
+	if err != nil {
+		return classifyDAVErr(err)
+	}
+	defer r.Close()
+	w, err := s.cli.Create(ctx, dst)
+	if err != nil {
+		return classifyDAVErr(err)
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if isMove {
+		return s.cli.RemoveAll(ctx, src)
+	}
+	return nil
+}
+
@@ -0,0 +1,140 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/emersion/go-webdav"
+)
+
+// Sentinel errors surfaced through the Storage interface so the cluster can
+// tell a transient failure apart from one that needs operator attention or a
+// different retry strategy.
+var (
+	// ErrDAVQuotaExceeded means the server has no space left to store the file.
+	ErrDAVQuotaExceeded = errors.New("webdav: quota exceeded")
+	// ErrDAVLocked means the resource is locked by another client; the caller
+	// should wait and retry rather than mark the node unhealthy.
+	ErrDAVLocked = errors.New("webdav: resource locked")
+	// ErrDAVPreconditionFailed means an If/If-Match precondition didn't hold,
+	// e.g. a stale lock token or a conflicting overwrite.
+	ErrDAVPreconditionFailed = errors.New("webdav: precondition failed")
+	// ErrDAVNotFound means the requested resource doesn't exist on the server.
+	ErrDAVNotFound = errors.New("webdav: not found")
+)
+
+// davError wraps a classified WebDAV failure, keeping the original HTTP
+// status and server-provided message around for logging.
+type davError struct {
+	Status   int
+	Message  string
+	Sentinel error
+}
+
+func (e *davError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("%v (status %d: %s)", e.Sentinel, e.Status, e.Message)
+	}
+	return fmt.Sprintf("%v (status %d)", e.Sentinel, e.Status)
+}
+
+func (e *davError) Unwrap() error {
+	return e.Sentinel
+}
+
+// davErrorXML matches both the plain RFC 4918 <d:error> body and the
+// Sabre/DAV flavor used by Nextcloud/ownCloud, which nests the same
+// <s:exception>/<s:message> elements under the DAV: namespace.
+type davErrorXML struct {
+	XMLName   xml.Name `xml:"error"`
+	ErrorCode string   `xml:"errorcode"`
+	Exception string   `xml:"exception"`
+	Message   string   `xml:"message"`
+}
+
+// classifyDAVStatus maps an HTTP status code (and, when present, a parsed
+// DAV error body) to one of the typed sentinel errors above.
+func classifyDAVStatus(status int, body *davErrorXML) error {
+	msg := ""
+	if body != nil {
+		if body.Message != "" {
+			msg = body.Message
+		} else {
+			msg = body.Exception
+		}
+	}
+	sentinel := classifyDAVSentinel(status, body)
+	return &davError{Status: status, Message: msg, Sentinel: sentinel}
+}
+
+func classifyDAVSentinel(status int, body *davErrorXML) error {
+	// A DAV: precondition errorcode is more specific than the bare status
+	// (e.g. a 412 carrying "lock-token-submitted" means the resource is
+	// locked by someone else, not just a generic failed precondition).
+	if body != nil {
+		switch body.ErrorCode {
+		case "quota-exceeded", "insufficient-storage":
+			return ErrDAVQuotaExceeded
+		case "lock-token-submitted", "no-conflicting-lock":
+			return ErrDAVLocked
+		}
+	}
+	switch status {
+	case http.StatusInsufficientStorage:
+		return ErrDAVQuotaExceeded
+	case http.StatusLocked:
+		return ErrDAVLocked
+	case http.StatusPreconditionFailed:
+		return ErrDAVPreconditionFailed
+	case http.StatusNotFound, http.StatusGone:
+		return ErrDAVNotFound
+	}
+	return webdav.NewHTTPError(status, nil)
+}
+
+// parseDAVError reads and classifies a non-2xx WebDAV response body. The
+// body is consumed but not closed; the caller remains responsible for that.
+func parseDAVError(status int, body io.Reader) error {
+	var parsed davErrorXML
+	if err := xml.NewDecoder(body).Decode(&parsed); err != nil {
+		return classifyDAVStatus(status, nil)
+	}
+	return classifyDAVStatus(status, &parsed)
+}
+
+// classifyDAVErr re-classifies an error already returned by the emersion
+// webdav client. It only adds value for *webdav.HTTPError, since that's the
+// only error type carrying a status code without a body we can inspect (the
+// client already drains and discards the response body on error).
+func classifyDAVErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	var herr *webdav.HTTPError
+	if !errors.As(err, &herr) {
+		return err
+	}
+	return &davError{Status: herr.Code, Sentinel: classifyDAVSentinel(herr.Code, nil)}
+}
@@ -0,0 +1,91 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestParseDAVError(t *testing.T) {
+	cases := []struct {
+		name   string
+		status int
+		body   string
+		want   error
+	}{
+		{
+			name:   "nextcloud quota exceeded",
+			status: http.StatusInsufficientStorage,
+			body: `<?xml version="1.0" encoding="utf-8"?>
+<d:error xmlns:d="DAV:" xmlns:s="http://sabredav.org/ns">
+  <s:exception>Sabre\DAV\Exception\InsufficientStorage</s:exception>
+  <s:message>Insufficient storage</s:message>
+</d:error>`,
+			want: ErrDAVQuotaExceeded,
+		},
+		{
+			name:   "owncloud locked",
+			status: http.StatusLocked,
+			body: `<?xml version="1.0" encoding="utf-8"?>
+<d:error xmlns:d="DAV:" xmlns:s="http://sabredav.org/ns">
+  <s:exception>Sabre\DAV\Exception\Locked</s:exception>
+  <s:message>the resource is locked</s:message>
+</d:error>`,
+			want: ErrDAVLocked,
+		},
+		{
+			name:   "sabredav precondition failed",
+			status: http.StatusPreconditionFailed,
+			body: `<?xml version="1.0" encoding="utf-8"?>
+<d:error xmlns:d="DAV:">
+  <d:errorcode>lock-token-submitted</d:errorcode>
+  <d:message>the If header did not contain a valid lock token</d:message>
+</d:error>`,
+			want: ErrDAVLocked,
+		},
+		{
+			name:   "nginx-dav not found, no body",
+			status: http.StatusNotFound,
+			body:   "",
+			want:   ErrDAVNotFound,
+		},
+		{
+			name:   "plain rfc4918 error without sabre namespace",
+			status: http.StatusPreconditionFailed,
+			body: `<?xml version="1.0" encoding="utf-8"?>
+<d:error xmlns:d="DAV:">
+  <d:message>If header precondition failed</d:message>
+</d:error>`,
+			want: ErrDAVPreconditionFailed,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := parseDAVError(c.status, strings.NewReader(c.body))
+			if !errors.Is(err, c.want) {
+				t.Fatalf("parseDAVError(%d, %q) = %v, want wrapping %v", c.status, c.body, err, c.want)
+			}
+		})
+	}
+}
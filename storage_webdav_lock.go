@@ -0,0 +1,420 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-webdav"
+	memlock "golang.org/x/net/webdav"
+)
+
+// webdavLockMode selects how a WebDavStorage coordinates concurrent writers.
+type webdavLockMode string
+
+const (
+	// WebdavLockServer issues real RFC 4918 LOCK/UNLOCK requests against the
+	// remote server before mutating a path. This is the default, since it's
+	// the only mode that protects shared buckets across multiple nodes.
+	WebdavLockServer webdavLockMode = "server"
+	// WebdavLockMemory arbitrates locks locally with golang.org/x/net/webdav's
+	// in-memory LockSystem. It cannot stop another process from writing the
+	// same path, but it's the best we can do against a server that doesn't
+	// speak DAV class 2.
+	WebdavLockMemory webdavLockMode = "memory"
+	// WebdavLockNone disables locking entirely, restoring the old behavior.
+	WebdavLockNone webdavLockMode = "none"
+)
+
+const defaultLockTimeout = 4 * time.Minute
+
+// LockError wraps a failure to acquire, refresh, or release a WebDAV lock so
+// callers (namely the sync loop) can tell it apart from an ordinary I/O error
+// and decide to retry instead of marking the node unhealthy.
+type LockError struct {
+	Path string
+	Err  error
+}
+
+func (e *LockError) Error() string {
+	return fmt.Sprintf("webdav: could not lock %q: %v", e.Path, e.Err)
+}
+
+func (e *LockError) Unwrap() error {
+	return e.Err
+}
+
+// webdavHeldLock represents an active lock on a single path, either granted
+// by the remote server (token != "") or arbitrated in-memory by memLS.
+type webdavHeldLock struct {
+	locker *webdavLocker
+	path   string
+	token  string // opaque Lock-Token; empty when using the memory fallback
+
+	cancelRefresh context.CancelFunc
+	release       func() // memLS release func; nil when token != ""
+}
+
+// ifHeader returns the "If" header value that must be attached to any
+// subsequent PUT/PROPFIND/DELETE performed under this lock. It is a no-op
+// (empty string) when locking is disabled or arbitrated purely in-memory.
+func (l *webdavHeldLock) ifHeader() string {
+	if l == nil || l.token == "" {
+		return ""
+	}
+	return fmt.Sprintf("(<%s>)", l.token)
+}
+
+// unlock releases the lock. It never returns an error to the caller since a
+// failed UNLOCK just means the server-side lock will expire on its own after
+// the timeout; the failure is logged here instead.
+func (l *webdavHeldLock) unlock() {
+	if l == nil {
+		return
+	}
+	if l.cancelRefresh != nil {
+		l.cancelRefresh()
+	}
+	if l.release != nil {
+		l.release()
+		return
+	}
+	if l.token == "" {
+		return
+	}
+	if err := l.locker.unlockRemote(context.Background(), l.path, l.token); err != nil {
+		logErrorf("Could not unlock %q: %v", l.path, err)
+	}
+}
+
+// webdavLocker acquires per-path locks for a WebDavStorage. A nil locker, or
+// one created via newWebdavLocker with mode == WebdavLockNone, is a no-op.
+type webdavLocker struct {
+	mode    webdavLockMode
+	timeout time.Duration
+
+	cli  webdav.HTTPClient
+	base string // full endpoint, e.g. "https://example.com/dav/"
+	name string // storage name, only used for log messages
+
+	memLS memlock.LockSystem
+
+	mu             sync.Mutex
+	serverRejected bool // LOCK returned 501/405 once; stop retrying it
+}
+
+func newWebdavLocker(mode webdavLockMode, timeout time.Duration, cli webdav.HTTPClient, base, name string) *webdavLocker {
+	if timeout <= 0 {
+		timeout = defaultLockTimeout
+	}
+	l := &webdavLocker{
+		mode:    mode,
+		timeout: timeout,
+		cli:     cli,
+		base:    base,
+		name:    name,
+	}
+	if mode == WebdavLockMemory {
+		l.memLS = memlock.NewMemLS()
+	}
+	return l
+}
+
+// lock acquires an exclusive write lock on p, refreshing it in the background
+// for as long as the returned lock is held. Callers must call unlock() on the
+// result (even on a nil-mode locker, where it's a harmless no-op).
+func (l *webdavLocker) lock(ctx context.Context, p string) (*webdavHeldLock, error) {
+	if l == nil || l.mode == WebdavLockNone {
+		return &webdavHeldLock{}, nil
+	}
+
+	l.mu.Lock()
+	fellBack := l.serverRejected
+	l.mu.Unlock()
+
+	if l.mode == WebdavLockMemory || fellBack {
+		return l.lockMemory(p)
+	}
+
+	token, err := l.lockRemote(ctx, p)
+	if err != nil {
+		if isUnsupportedLockStatus(err) {
+			logErrorf("WebDAV storage %s does not support LOCK, falling back to in-memory locking", l.name)
+			l.mu.Lock()
+			l.serverRejected = true
+			if l.memLS == nil {
+				l.memLS = memlock.NewMemLS()
+			}
+			l.mu.Unlock()
+			return l.lockMemory(p)
+		}
+		return nil, &LockError{Path: p, Err: err}
+	}
+
+	refreshCtx, cancel := context.WithCancel(context.Background())
+	held := &webdavHeldLock{locker: l, path: p, token: token, cancelRefresh: cancel}
+	go l.autoRefresh(refreshCtx, p, token)
+	return held, nil
+}
+
+// lockMemory arbitrates a lock on p purely within this process. We go
+// straight to Create: memLS.Confirm only succeeds given a lock token we
+// already hold (it's meant for re-entering a lock across requests from the
+// same client), and we never have one here, so calling it first would just
+// be a guaranteed-failing round trip before the Create that actually
+// enforces exclusion.
+func (l *webdavLocker) lockMemory(p string) (*webdavHeldLock, error) {
+	now := time.Now()
+	token, err := l.memLS.Create(now, memlock.LockDetails{
+		Root:      p,
+		Duration:  l.timeout,
+		ZeroDepth: true,
+	})
+	if err != nil {
+		return nil, &LockError{Path: p, Err: err}
+	}
+	refreshCtx, cancel := context.WithCancel(context.Background())
+	held := &webdavHeldLock{
+		locker:        l,
+		path:          p,
+		cancelRefresh: cancel,
+		release: func() {
+			l.memLS.Unlock(time.Now(), token)
+		},
+	}
+	go l.autoRefreshMemory(refreshCtx, token)
+	return held, nil
+}
+
+// autoRefreshMemory keeps an in-memory lock alive for as long as ctx is not
+// cancelled. Without this, a write that runs longer than l.timeout would let
+// a second Create on the same path succeed mid-write, since memLS treats the
+// lock as expired once its Duration has elapsed.
+func (l *webdavLocker) autoRefreshMemory(ctx context.Context, token string) {
+	interval := l.timeout * 3 / 5
+	if interval <= 0 {
+		interval = defaultLockTimeout * 3 / 5
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := l.memLS.Refresh(time.Now(), token, l.timeout); err != nil {
+				logErrorf("Could not refresh in-memory lock: %v", err)
+				return
+			}
+		}
+	}
+}
+
+// lockRequestBody is the RFC 4918 §9.10.7 LOCK request body for an exclusive
+// write lock.
+const lockRequestBody = `<?xml version="1.0" encoding="utf-8"?>` +
+	`<D:lockinfo xmlns:D="DAV:">` +
+	`<D:lockscope><D:exclusive/></D:lockscope>` +
+	`<D:locktype><D:write/></D:locktype>` +
+	`</D:lockinfo>`
+
+type davLockDiscoveryResp struct {
+	XMLName xml.Name `xml:"prop"`
+	Locks   []struct {
+		Token struct {
+			Href string `xml:"href"`
+		} `xml:"locktoken"`
+	} `xml:"lockdiscovery>activelock"`
+}
+
+func (l *webdavLocker) lockRemote(ctx context.Context, p string) (token string, err error) {
+	target := joinDavPath(l.base, p)
+	req, err := http.NewRequestWithContext(ctx, "LOCK", target, bytes.NewReader([]byte(lockRequestBody)))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", `application/xml; charset="utf-8"`)
+	req.Header.Set("Timeout", fmt.Sprintf("Second-%d", int(l.timeout.Seconds())))
+	req.Header.Set("Depth", "0")
+	resp, err := l.cli.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return "", webdav.NewHTTPError(resp.StatusCode, nil)
+	}
+	if tok := resp.Header.Get("Lock-Token"); tok != "" {
+		return strings.Trim(tok, "<>"), nil
+	}
+	// Some servers only report the token in the response body.
+	var body davLockDiscoveryResp
+	if derr := xml.NewDecoder(resp.Body).Decode(&body); derr == nil {
+		for _, lk := range body.Locks {
+			if lk.Token.Href != "" {
+				return strings.Trim(lk.Token.Href, "<>"), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("webdav: server did not return a Lock-Token for %q", p)
+}
+
+func (l *webdavLocker) refreshRemote(ctx context.Context, p, token string) error {
+	target := joinDavPath(l.base, p)
+	req, err := http.NewRequestWithContext(ctx, "LOCK", target, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("If", fmt.Sprintf("(<%s>)", token))
+	req.Header.Set("Timeout", fmt.Sprintf("Second-%d", int(l.timeout.Seconds())))
+	resp, err := l.cli.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return webdav.NewHTTPError(resp.StatusCode, nil)
+	}
+	return nil
+}
+
+func (l *webdavLocker) unlockRemote(ctx context.Context, p, token string) error {
+	target := joinDavPath(l.base, p)
+	req, err := http.NewRequestWithContext(ctx, "UNLOCK", target, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Lock-Token", fmt.Sprintf("<%s>", token))
+	resp, err := l.cli.Do(req)
+	if err != nil {
+		return err
+	}
+	defer io.Copy(io.Discard, resp.Body)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return webdav.NewHTTPError(resp.StatusCode, nil)
+	}
+	return nil
+}
+
+// autoRefresh keeps a server-side lock alive for as long as ctx is not
+// cancelled, renewing it at roughly 60% of the lock timeout.
+func (l *webdavLocker) autoRefresh(ctx context.Context, p, token string) {
+	interval := l.timeout * 3 / 5
+	if interval <= 0 {
+		interval = defaultLockTimeout * 3 / 5
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := l.refreshRemote(ctx, p, token); err != nil {
+				logErrorf("Could not refresh lock on %q: %v", p, err)
+				return
+			}
+		}
+	}
+}
+
+func isUnsupportedLockStatus(err error) bool {
+	var herr *webdav.HTTPError
+	if !errors.As(err, &herr) {
+		return false
+	}
+	return herr.Code == http.StatusNotImplemented || herr.Code == http.StatusMethodNotAllowed
+}
+
+// rawPutWriteCloser streams writes into a PUT issued by hand (rather than
+// through webdav.Client.Create), so that the lock's token can be attached as
+// an "If" header per RFC 4918 §7 and the write itself is honored by the very
+// lock that was just taken. It releases the lock on Close.
+type rawPutWriteCloser struct {
+	pw   *io.PipeWriter
+	done chan error
+	lock *webdavHeldLock
+}
+
+// createLocked PUTs to p, carrying lock's token (if any) in the "If" header,
+// streaming the request body from the writes made to the returned
+// io.WriteCloser.
+func (s *WebDavStorage) createLocked(ctx context.Context, p string, lock *webdavHeldLock) io.WriteCloser {
+	pr, pw := io.Pipe()
+	target := joinDavPath(s.opt.GetEndPoint(), p)
+	done := make(chan error, 1)
+	go func() {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, target, pr)
+		if err != nil {
+			pr.CloseWithError(err)
+			done <- err
+			return
+		}
+		req.SetBasicAuth(s.opt.GetUsername(), s.opt.GetPassword())
+		if ifh := lock.ifHeader(); ifh != "" {
+			req.Header.Set("If", ifh)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			pr.CloseWithError(err)
+			done <- err
+			return
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			err := parseDAVError(resp.StatusCode, resp.Body)
+			pr.CloseWithError(err)
+			done <- err
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		done <- nil
+	}()
+	return &rawPutWriteCloser{pw: pw, done: done, lock: lock}
+}
+
+func (w *rawPutWriteCloser) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+func (w *rawPutWriteCloser) Close() error {
+	defer w.lock.unlock()
+	if err := w.pw.Close(); err != nil {
+		return err
+	}
+	return <-w.done
+}
+
+// joinDavPath joins a WebDAV endpoint with a path relative to it without
+// escaping the path segments (they're already URL-safe hash/measure names).
+func joinDavPath(base, p string) string {
+	base = strings.TrimSuffix(base, "/")
+	return base + "/" + strings.TrimPrefix(p, "/")
+}